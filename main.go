@@ -4,20 +4,33 @@ import (
 	"context"
 	"encoding/csv"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	cwTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 )
 
 var (
@@ -26,18 +39,130 @@ var (
 	period    int32 = 38880000
 )
 
+// cloudwatchLimiter paces GetMetricData calls so a highly concurrent scan doesn't trip
+// CloudWatch's GetMetricData TPS limit (400 calls/sec); ec2Limiter independently paces
+// the ModifyInstanceMetadataOptions calls made by -enforce. DescribeRegions and
+// DescribeInstances calls are not paced by either. Burst of 1 keeps calls smooth
+// rather than bursty.
+var (
+	ec2Limiter        = rate.NewLimiter(rate.Limit(20), 1)
+	cloudwatchLimiter = rate.NewLimiter(rate.Limit(350), 1)
+)
+
+// cloudwatchChunkConcurrency bounds how many GetMetricData chunks a single region
+// scan issues in flight at once.
+const cloudwatchChunkConcurrency = 4
+
+// maxRetries is the number of attempts withBackoff makes for a retryable AWS error
+// before giving up and returning it to the caller.
+const maxRetries = 5
+
+// awsErrorCode returns the smithy API error code for err, or "" if err isn't one.
+func awsErrorCode(err error) string {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		return ae.ErrorCode()
+	}
+	return ""
+}
+
+// isRetryableAWSError reports whether err is a throttling-style AWS error worth
+// retrying, as opposed to e.g. UnauthorizedOperation, which won't succeed on retry.
+func isRetryableAWSError(err error) bool {
+	switch awsErrorCode(err) {
+	case "RequestLimitExceeded", "Throttling", "ThrottlingException", "TooManyRequestsException":
+		return true
+	}
+	return false
+}
+
+// withBackoff calls fn, retrying with exponential backoff and jitter while it
+// returns a retryable AWS error, up to maxRetries attempts. Non-retryable errors
+// and context cancellation are returned immediately.
+func withBackoff(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if !isRetryableAWSError(err) {
+			return err
+		}
+
+		base := time.Duration(math.Pow(2, float64(attempt))) * 100 * time.Millisecond
+		wait := base + time.Duration(rand.Int63n(int64(base)))
+		slog.Warn("retrying throttled AWS call", "attempt", attempt+1, "wait", wait, "error", err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// skipTracker records regions that were skipped during a scan along with why, so
+// main can print a summary once all region scans have finished.
+type skipTracker struct {
+	mu    sync.Mutex
+	skips []string
+}
+
+func (s *skipTracker) record(region, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skips = append(s.skips, fmt.Sprintf("%s: %s", region, reason))
+}
+
 type RegionInstances struct {
 	region    string
 	instances []*Ec2Instance
+	duration  time.Duration
 }
 
+// imdsv1CallsTotal and scanDurationSeconds are published by the serve subcommand so
+// teams can alert on non-zero IMDSv1 usage instead of diffing CSVs.
+var (
+	imdsv1CallsTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imdsv1_calls_total",
+		Help: "Sum of MetadataNoToken CloudWatch calls observed for an instance over the lookback window.",
+	}, []string{"region", "instance_id", "account_id"})
+
+	scanDurationSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imdsv1_scan_duration_seconds",
+		Help: "How long the most recent scan of a region took.",
+	}, []string{"region"})
+)
+
 type Ec2Instance struct {
 	instanceId           string
 	metadataNoTokenCalls float64
+	httpTokensState      string
+	enforcedState        string
+	enforceErr           string
+	tags                 map[string]string
+	accountId            string
+	launchTime           time.Time
+	instanceType         string
+	platformDetails      string
+}
+
+// EC2API is the subset of the ec2.Client surface this tool calls. Satisfied by
+// *ec2.Client; tests substitute a mock. DescribeInstances is declared with the
+// exact signature ec2.NewDescribeInstancesPaginator expects so an EC2API value
+// can be passed straight into it.
+type EC2API interface {
+	DescribeRegions(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error)
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	ModifyInstanceMetadataOptions(ctx context.Context, params *ec2.ModifyInstanceMetadataOptionsInput, optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceMetadataOptionsOutput, error)
 }
 
-type ec2DescribeRegions interface {
-	DescribeRegions(ctx context.Context, params *ec2.DescribeRegionsInput, optsFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error)
+// CloudWatchAPI is the subset of the cloudwatch.Client surface this tool calls.
+// Satisfied by *cloudwatch.Client; tests substitute a mock.
+type CloudWatchAPI interface {
+	GetMetricStatistics(ctx context.Context, params *cloudwatch.GetMetricStatisticsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricStatisticsOutput, error)
+	GetMetricData(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error)
 }
 
 type ec2DescribeInstancesPaginator interface {
@@ -45,102 +170,416 @@ type ec2DescribeInstancesPaginator interface {
 	NextPage(ctx context.Context, optsFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
 }
 
+// newEC2Client and newCloudWatchClient construct the real AWS clients used by
+// scanAllRegions/scanRegion. Overridden in tests so the concurrent scan logic can
+// be exercised against EC2API/CloudWatchAPI mocks instead of live AWS calls.
+var (
+	newEC2Client        = func(cfg aws.Config) EC2API { return ec2.NewFromConfig(cfg) }
+	newCloudWatchClient = func(cfg aws.Config) CloudWatchAPI { return cloudwatch.NewFromConfig(cfg) }
+)
+
 func main() {
-	ctx := context.Background()
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("us-west-2"))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("us-west-2"))
 	if err != nil {
 		log.Fatalf("unable to load AWS SDK config: %v", err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		if err := serve(ctx, cfg, os.Args[2:]); err != nil && !errors.Is(err, context.Canceled) {
+			log.Fatalf("serve: %v", err)
+		}
+		return
+	}
+
+	runOneShot(ctx, cfg, os.Args[1:])
+}
+
+// runOneShot parses the default CLI flags, scans every accessible region once (in
+// one account, or one account per line of -accounts-file), and writes the results
+// to instances.csv.
+func runOneShot(ctx context.Context, cfg aws.Config, args []string) {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	enforce := fs.Bool("enforce", false, "remediate instances with zero metadatanotoken calls by setting HttpTokens=required")
+	dryRun := fs.Bool("dry-run", false, "with -enforce, only log the planned HttpTokens change instead of calling ModifyInstanceMetadataOptions")
+	allowList := fs.String("allow", "", "comma separated instance ids to restrict -enforce to (default: all eligible instances)")
+	denyList := fs.String("deny", "", "comma separated instance ids to exclude from -enforce")
+	hopLimit := fs.Int("hop-limit", 0, "with -enforce, HttpPutResponseHopLimit to set (0 leaves it unchanged)")
+	concurrency := fs.Int("concurrency", 5, "number of regions to scan concurrently")
+	tagFilter := fs.String("tag-filter", "", "key=value tag to restrict the scan to (default: all instances)")
+	tagColumns := fs.String("tag-columns", "", "comma separated tag keys to add as extra CSV columns")
+	assumeRole := fs.String("assume-role", "", "role arn to assume for a single cross-account scan")
+	accountsFile := fs.String("accounts-file", "", "path to a file of one role arn per line, scanned in turn instead of -assume-role")
+	fs.Parse(args)
+
+	allow := parseIdList(*allowList)
+	deny := parseIdList(*denyList)
+	tagKey, tagValue := parseTagFilter(*tagFilter)
+	tagColumnNames := parseColumnList(*tagColumns)
+
+	roleArns, err := roleArnsToAssume(*assumeRole, *accountsFile)
+	if err != nil {
+		log.Fatalf("unable to read -accounts-file: %v", err)
+	}
+
 	// Create CSV for writing, defer the close, and write header row
 	writer, file, err := openCSV("instances.csv")
-	defer file.Close()
 	if err != nil {
 		log.Fatalf("unable to open file: %v", err)
 	}
-	writeToCSV(writer, []string{"region", "instance-id", "imdsv1 calls"})
+	defer file.Close()
+	header := []string{"region", "instance-id", "account-id", "instance-type", "launch-time", "platform-details", "imdsv1 calls", "http-tokens-pre", "http-tokens-post", "enforce-error"}
+	header = append(header, tagColumnNames...)
+	if err := writeToCSV(writer, header); err != nil {
+		log.Fatalf("unable to write csv header: %v", err)
+	}
 
-	// establish ec2 client and get accessible regions
-	ec2Client := ec2.NewFromConfig(cfg)
-	regions := retrieveRegions(ctx, ec2Client)
+	for _, roleArn := range roleArns {
+		scanCfg := cfg
+		if roleArn != "" {
+			scanCfg, err = assumeRoleConfig(ctx, cfg, roleArn)
+			if err != nil {
+				slog.Warn("unable to assume role, skipping account", "role-arn", roleArn, "error", err)
+				continue
+			}
+		}
 
-	// loop through regions to retrieve instances and their metadatanotoken calls
-	for _, region := range regions {
-		if region.RegionName == nil {
+		results, skips, err := scanAllRegions(ctx, scanCfg, *concurrency, *enforce, *dryRun, allow, deny, int32(*hopLimit), tagKey, tagValue)
+		if err != nil {
+			slog.Warn("unable to scan account, skipping", "role-arn", roleArn, "error", err)
 			continue
 		}
 
-		regionInstances := RegionInstances{region: *region.RegionName}
-		cfg.Region = regionInstances.region
+		for ri := range results {
+			fmt.Printf("====================== %s instances with metadatanotoken metric greater than 0 ======================\n", ri.region)
+			for _, v := range ri.instances {
+				if v.metadataNoTokenCalls > 0 {
+					fmt.Printf("Instance Id: %v | MetadataNoToken Calls: %v\n", v.instanceId, v.metadataNoTokenCalls)
+				}
+			}
 
-		fmt.Printf("=========== %s ===========\n", regionInstances.region)
-		regionalEc2Client := ec2.NewFromConfig(cfg)
-		ec2Paginator := ec2.NewDescribeInstancesPaginator(regionalEc2Client, &ec2.DescribeInstancesInput{})
-		err := regionInstances.retrieveInstances(ctx, ec2Paginator)
+			for _, e := range ri.instances {
+				row := []string{
+					ri.region,
+					e.instanceId,
+					e.accountId,
+					e.instanceType,
+					e.launchTime.Format(time.RFC3339),
+					e.platformDetails,
+					strconv.FormatFloat(e.metadataNoTokenCalls, 'f', 2, 64),
+					e.httpTokensState,
+					e.enforcedState,
+					e.enforceErr,
+				}
+				for _, col := range tagColumnNames {
+					row = append(row, e.tags[col])
+				}
+				if err := writeToCSV(writer, row); err != nil {
+					slog.Warn("failed to write csv row", "row", row, "error", err)
+				}
+			}
+		}
 
-		// move to next reason if there's an error retrieving instances
-		if err != nil {
-			slog.Warn("error received when retrieving instances, moving to next region", "msg", err)
+		if len(skips.skips) > 0 {
+			fmt.Printf("====================== skipped regions ======================\n")
+			for _, s := range skips.skips {
+				fmt.Printf("%s\n", s)
+			}
+		}
+	}
+}
+
+// roleArnsToAssume returns the role arns to scan in turn: the contents of
+// accountsFile (one arn per line, blank lines and #-comments ignored) if set,
+// otherwise a single-element slice holding assumeRole (which may be "" for the
+// caller's own credentials).
+func roleArnsToAssume(assumeRole, accountsFile string) ([]string, error) {
+	if accountsFile == "" {
+		return []string{assumeRole}, nil
+	}
+
+	data, err := os.ReadFile(accountsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading accounts file %s: %w", accountsFile, err)
+	}
+
+	var roleArns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
+		roleArns = append(roleArns, line)
+	}
+	return roleArns, nil
+}
+
+// assumeRoleConfig returns a copy of cfg whose credentials come from assuming
+// roleArn, for scanning accounts other than the one the base credentials belong to.
+func assumeRoleConfig(ctx context.Context, cfg aws.Config, roleArn string) (aws.Config, error) {
+	stsClient := sts.NewFromConfig(cfg)
+	provider := stscreds.NewAssumeRoleProvider(stsClient, roleArn)
+
+	assumedCfg := cfg.Copy()
+	assumedCfg.Credentials = aws.NewCredentialsCache(provider)
+
+	if _, err := assumedCfg.Credentials.Retrieve(ctx); err != nil {
+		return aws.Config{}, fmt.Errorf("error assuming role %s: %w", roleArn, err)
+	}
+	return assumedCfg, nil
+}
+
+// serve parses the serve subcommand's flags, exposes /metrics via promhttp, and
+// re-scans all regions on the configured interval, publishing imdsv1CallsTotal and
+// scanDurationSeconds instead of writing a CSV.
+func serve(ctx context.Context, cfg aws.Config, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listenAddr := fs.String("listen-addr", ":9090", "address to serve /metrics on")
+	interval := fs.Duration("interval", 5*time.Minute, "how often to re-scan all regions")
+	concurrency := fs.Int("concurrency", 5, "number of regions to scan concurrently")
+	fs.Parse(args)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(imdsv1CallsTotal, scanDurationSeconds)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: *listenAddr, Handler: mux}
+
+	go func() {
+		slog.Info("serving metrics", "addr", *listenAddr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("metrics server exited", "error", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	accountId := lookupAccountId(ctx, cfg)
+
+	publishScan(ctx, cfg, *concurrency, accountId)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			publishScan(ctx, cfg, *concurrency, accountId)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// lookupAccountId returns the account id of the credentials cfg was loaded from, or
+// "" if it can't be determined. It's used as the account_id label on published metrics.
+func lookupAccountId(ctx context.Context, cfg aws.Config) string {
+	stsClient := sts.NewFromConfig(cfg)
+	identity, err := stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		slog.Warn("unable to determine account id for metrics", "error", err)
+		return ""
+	}
+	return aws.ToString(identity.Account)
+}
+
+// publishScan scans every accessible region once and updates imdsv1CallsTotal and
+// scanDurationSeconds from the results.
+func publishScan(ctx context.Context, cfg aws.Config, concurrency int, accountId string) {
+	results, skips, err := scanAllRegions(ctx, cfg, concurrency, false, false, nil, nil, 0, "", "")
+	if err != nil {
+		slog.Warn("skipping scan cycle", "error", err)
+		return
+	}
+
+	// Reset before repopulating so instances that no longer exist (the normal case
+	// for an autoscaled fleet) don't leave a stale, permanently-alerting time series.
+	imdsv1CallsTotal.Reset()
+	scanDurationSeconds.Reset()
+
+	for ri := range results {
+		scanDurationSeconds.WithLabelValues(ri.region).Set(ri.duration.Seconds())
+		for _, e := range ri.instances {
+			imdsv1CallsTotal.WithLabelValues(ri.region, e.instanceId, accountId).Set(e.metadataNoTokenCalls)
+		}
+	}
 
-		// continue on if no instances found
-		if len(regionInstances.instances) == 0 {
-			slog.Info("no ec2 instances found", "region", regionInstances.region)
+	for _, s := range skips.skips {
+		slog.Warn("region skipped during scan", "detail", s)
+	}
+}
+
+// scanAllRegions retrieves every accessible region and fans out scanRegion across a
+// bounded worker pool, streaming a *RegionInstances for each region that had
+// instances to report on the returned channel (closed once every region has been
+// scanned) alongside a
+// skipTracker recording any regions that failed. Shared by the one-shot CLI scan and
+// the serve subcommand's periodic re-scans.
+func scanAllRegions(ctx context.Context, cfg aws.Config, concurrency int, enforce, dryRun bool, allow, deny map[string]bool, hopLimit int32, tagKey, tagValue string) (<-chan *RegionInstances, *skipTracker, error) {
+	ec2Client := newEC2Client(cfg)
+	regions, err := retrieveRegions(ctx, ec2Client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	results := make(chan *RegionInstances)
+	skips := &skipTracker{}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+
+	for _, region := range regions {
+		region := region
+		if region.RegionName == nil {
 			continue
 		}
 
-		// retrieve metrics and print if metadatanotoken calls are greater than 0
-		regionInstances.retrieveCloudwatchMetrics(ctx, cfg)
-		fmt.Printf("====================== %s instances with metadatanotoken metric greater than 0 ======================\n", regionInstances.region)
-		for _, v := range regionInstances.instances {
-			if v.metadataNoTokenCalls > 0 {
-				fmt.Printf("Instance Id: %v | MetadataNoToken Calls: %v\n", v.instanceId, v.metadataNoTokenCalls)
+		g.Go(func() error {
+			return scanRegion(gctx, cfg, *region.RegionName, enforce, dryRun, allow, deny, hopLimit, tagKey, tagValue, results, skips)
+		})
+	}
+
+	go func() {
+		if err := g.Wait(); err != nil {
+			slog.Warn("scan aborted", "error", err)
+		}
+		close(results)
+	}()
+
+	return results, skips, nil
+}
+
+// scanRegion retrieves instances and their metadatanotoken calls for a single region,
+// optionally enforces IMDSv2, and sends the populated RegionInstances to results.
+// Errors retrieving instances or metrics are logged and recorded on skips rather
+// than failing the whole scan; a region with no (matching) instances is only logged
+// and sends nothing to results.
+func scanRegion(ctx context.Context, cfg aws.Config, region string, enforce, dryRun bool, allow, deny map[string]bool, hopLimit int32, tagKey, tagValue string, results chan<- *RegionInstances, skips *skipTracker) error {
+	start := time.Now()
+	regionInstances := &RegionInstances{region: region}
+	regionCfg := cfg
+	regionCfg.Region = region
+
+	fmt.Printf("=========== %s ===========\n", region)
+	regionalEc2Client := newEC2Client(regionCfg)
+	ec2Paginator := ec2.NewDescribeInstancesPaginator(regionalEc2Client, &ec2.DescribeInstancesInput{})
+	if err := regionInstances.retrieveInstances(ctx, ec2Paginator); err != nil {
+		slog.Warn("error received when retrieving instances, moving to next region", "region", region, "msg", err)
+		skips.record(region, fmt.Sprintf("retrieveInstances: %v", err))
+		return nil
+	}
+
+	if len(regionInstances.instances) == 0 {
+		slog.Info("no ec2 instances found", "region", region)
+		return nil
+	}
+
+	if tagKey != "" {
+		filtered := regionInstances.instances[:0]
+		for _, instance := range regionInstances.instances {
+			if matchesTagFilter(instance, tagKey, tagValue) {
+				filtered = append(filtered, instance)
 			}
 		}
+		regionInstances.instances = filtered
+	}
+
+	if len(regionInstances.instances) == 0 {
+		slog.Info("no ec2 instances matched -tag-filter", "region", region)
+		return nil
+	}
+
+	cloudwatchClient := newCloudWatchClient(regionCfg)
+	if err := regionInstances.retrieveCloudwatchMetrics(ctx, cloudwatchClient); err != nil {
+		slog.Warn("error retrieving cloudwatch metrics, moving to next region", "region", region, "msg", err)
+		skips.record(region, fmt.Sprintf("retrieveCloudwatchMetrics: %v", err))
+		return nil
+	}
+
+	// remediate instances with zero imdsv1 calls by requiring tokens
+	if enforce {
+		fmt.Printf("====================== %s enforcing IMDSv2 on eligible instances ======================\n", region)
+		regionInstances.enforceInstances(ctx, regionalEc2Client, dryRun, allow, deny, hopLimit)
+	}
+
+	regionInstances.duration = time.Since(start)
+
+	select {
+	case results <- regionInstances:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+// parseIdList splits a comma separated list of instance ids into a lookup set,
+// ignoring empty entries. An empty input yields an empty (non-nil) set.
+func parseIdList(list string) map[string]bool {
+	ids := make(map[string]bool)
+	for _, id := range strings.Split(list, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			ids[id] = true
+		}
+	}
+	return ids
+}
 
-		// write instances and their metadatanotoken calls to csv
-		for _, e := range regionInstances.instances {
-			var instanceRow []string
-			instanceRow = append(instanceRow, *region.RegionName)
-			instanceRow = append(instanceRow, e.instanceId)
-			instanceRow = append(instanceRow, strconv.FormatFloat(e.metadataNoTokenCalls, 'f', 2, 64))
-			writeToCSV(writer, instanceRow)
+// parseColumnList splits a comma separated list of CSV column names, trimming
+// whitespace and dropping empty entries, preserving the caller's order so
+// -tag-columns produces a stable, reproducible column order.
+func parseColumnList(list string) []string {
+	var columns []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			columns = append(columns, name)
 		}
 	}
+	return columns
 }
 
 // openCSV takes in a filename, attempts to create and open the file for writing, and returns a writer, file, and error
 func openCSV(filename string) (*csv.Writer, *os.File, error) {
 	f, err := os.Create(filename)
 	if err != nil {
-		log.Fatalf("error opening file: %v, error: %v", filename, err)
+		return nil, nil, fmt.Errorf("error opening file %s: %w", filename, err)
 	}
-	writer := csv.NewWriter(f)
-	return writer, f, nil
+	return csv.NewWriter(f), f, nil
 }
 
 // writeToCSV takes in the writer and data to write (should be: region, instanceid, metadatanotoken calls)
-func writeToCSV(w *csv.Writer, instanceRow []string) {
+func writeToCSV(w *csv.Writer, instanceRow []string) error {
 	if err := w.Write(instanceRow); err != nil {
-		log.Fatalf("error writing record to csv: %v", err)
+		return fmt.Errorf("error writing record to csv: %w", err)
 	}
 
 	if err := w.Error(); err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return nil
 }
 
-// retrieveRegions takes in a context and ec2DescribeRegions client and returns all regions
-// accessible to the context's user or role
-func retrieveRegions(ctx context.Context, ec2Client ec2DescribeRegions) []ec2Types.Region {
-	regions, err := ec2Client.DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
-
+// retrieveRegions lists the regions accessible to ec2Client, retrying throttling
+// errors with backoff. Unlike the per-region scan, a DescribeRegions failure aborts
+// the whole cycle since there are no regions to fall back to scanning individually.
+func retrieveRegions(ctx context.Context, ec2Client EC2API) ([]ec2Types.Region, error) {
+	var regions *ec2.DescribeRegionsOutput
+	err := withBackoff(ctx, func() error {
+		var describeErr error
+		regions, describeErr = ec2Client.DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
+		return describeErr
+	})
 	if err != nil {
-		log.Fatalf("unable to retrieve regions: %v", err)
+		return nil, fmt.Errorf("unable to retrieve regions: %w", err)
 	}
-	return regions.Regions
+	return regions.Regions, nil
 }
 
 // addInstance adds an instance to the regionInstance struct
@@ -149,65 +588,240 @@ func (r *RegionInstances) addInstance(instance *Ec2Instance) {
 }
 
 // retrieveInstances takes in a context and ec2DescribeInstancesPaginator, attempts to retrieve all
-// instances in the region, add them to the calling regionInstance, and returns any error received
+// instances in the region, add them to the calling regionInstance, and returns any error received.
+// Throttling errors are retried with backoff; UnauthorizedOperation and any other error are
+// returned immediately since retrying them won't help.
 func (r *RegionInstances) retrieveInstances(ctx context.Context, paginator ec2DescribeInstancesPaginator) error {
 	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(ctx)
+		var page *ec2.DescribeInstancesOutput
+		err := withBackoff(ctx, func() error {
+			var pageErr error
+			page, pageErr = paginator.NextPage(ctx)
+			return pageErr
+		})
 		if err != nil {
-			var ae smithy.APIError
-			if errors.As(err, &ae) {
-				if ae.ErrorCode() == "UnathorizedOperation" {
-					slog.Warn("you are not authorized to perform this action", "error", ae.ErrorMessage())
-					return err
-				}
+			if awsErrorCode(err) == "UnauthorizedOperation" {
+				slog.Warn("you are not authorized to perform this action", "error", err)
 			}
-			log.Fatalf("failed to retrieve instances: %v", err)
-			return nil
+			return fmt.Errorf("failed to retrieve instances: %w", err)
 		}
 
 		for _, reservation := range page.Reservations {
 			for _, instance := range reservation.Instances {
-				r.addInstance(&Ec2Instance{instanceId: *instance.InstanceId, metadataNoTokenCalls: 0.0})
+				httpTokensState := ""
+				if instance.MetadataOptions != nil {
+					httpTokensState = string(instance.MetadataOptions.HttpTokens)
+				}
+				var launchTime time.Time
+				if instance.LaunchTime != nil {
+					launchTime = *instance.LaunchTime
+				}
+				r.addInstance(&Ec2Instance{
+					instanceId:           *instance.InstanceId,
+					metadataNoTokenCalls: 0.0,
+					httpTokensState:      httpTokensState,
+					tags:                 tagsToMap(instance.Tags),
+					accountId:            aws.ToString(reservation.OwnerId),
+					launchTime:           launchTime,
+					instanceType:         string(instance.InstanceType),
+					platformDetails:      aws.ToString(instance.PlatformDetails),
+				})
 			}
 		}
 	}
 	return nil
 }
 
-// retrieveCloudwatchMetrics takes in a context and aws config, retrieves all metadatanotoken calls
-// for the instances that are in the calling RegionInstances struct
-func (r *RegionInstances) retrieveCloudwatchMetrics(ctx context.Context, cfg aws.Config) {
-	cloudwatchCfg := cfg
-	cloudwatchCfg.Region = r.region
-	cloudwatchClient := cloudwatch.NewFromConfig(cloudwatchCfg)
+// tagsToMap converts the Tags slice on a DescribeInstances response entry into a
+// key/value map for filtering and CSV column projection.
+func tagsToMap(tags []ec2Types.Tag) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(tags))
+	for _, t := range tags {
+		m[aws.ToString(t.Key)] = aws.ToString(t.Value)
+	}
+	return m
+}
 
-	for _, instance := range r.instances {
-		slog.Info("retrieving cloudwatch metrics for instance", "instance id", instance.instanceId)
-		input := &cloudwatch.GetMetricStatisticsInput{
-			Namespace:  aws.String("AWS/EC2"),
-			MetricName: aws.String("MetadataNoToken"),
-			Dimensions: []cwTypes.Dimension{
-				{
-					Name:  aws.String("InstanceId"),
-					Value: aws.String(instance.instanceId),
+// matchesTagFilter reports whether instance carries the given tag key/value. An
+// empty key always matches, so scans without -tag-filter see every instance.
+func matchesTagFilter(instance *Ec2Instance, key, value string) bool {
+	if key == "" {
+		return true
+	}
+	return instance.tags[key] == value
+}
+
+// parseTagFilter splits a "key=value" flag value into its key and value. A blank
+// filter (the default) yields an empty key, which matchesTagFilter treats as
+// match-everything.
+func parseTagFilter(filter string) (key, value string) {
+	if filter == "" {
+		return "", ""
+	}
+	k, v, _ := strings.Cut(filter, "=")
+	return k, v
+}
+
+// maxMetricDataQueries is the maximum number of MetricDataQuery entries CloudWatch
+// accepts in a single GetMetricData call.
+const maxMetricDataQueries = 500
+
+// retrieveCloudwatchMetrics takes in a context and CloudWatchAPI client, retrieves all
+// metadatanotoken calls for the instances that are in the calling RegionInstances struct.
+// Instances are queried in batches of maxMetricDataQueries via GetMetricData rather than
+// one GetMetricStatistics call per instance, since a region can hold thousands of instances.
+func (r *RegionInstances) retrieveCloudwatchMetrics(ctx context.Context, cloudwatchClient CloudWatchAPI) error {
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(cloudwatchChunkConcurrency)
+
+	for start := 0; start < len(r.instances); start += maxMetricDataQueries {
+		end := start + maxMetricDataQueries
+		if end > len(r.instances) {
+			end = len(r.instances)
+		}
+		chunk := r.instances[start:end]
+
+		g.Go(func() error {
+			return r.retrieveCloudwatchMetricsChunk(gctx, cloudwatchClient, chunk)
+		})
+	}
+
+	return g.Wait()
+}
+
+// retrieveCloudwatchMetricsChunk issues one or more (paginated) GetMetricData calls for a
+// single chunk of at most maxMetricDataQueries instances and accumulates the summed values
+// onto each instance. Throttling errors are retried with backoff; any other error is
+// returned to the caller.
+func (r *RegionInstances) retrieveCloudwatchMetricsChunk(ctx context.Context, cloudwatchClient CloudWatchAPI, chunk []*Ec2Instance) error {
+	idToInstance := make(map[string]*Ec2Instance, len(chunk))
+	queries := make([]cwTypes.MetricDataQuery, 0, len(chunk))
+
+	for i, instance := range chunk {
+		id := fmt.Sprintf("m%d", i)
+		idToInstance[id] = instance
+		queries = append(queries, cwTypes.MetricDataQuery{
+			Id: aws.String(id),
+			MetricStat: &cwTypes.MetricStat{
+				Metric: &cwTypes.Metric{
+					Namespace:  aws.String("AWS/EC2"),
+					MetricName: aws.String("MetadataNoToken"),
+					Dimensions: []cwTypes.Dimension{
+						{
+							Name:  aws.String("InstanceId"),
+							Value: aws.String(instance.instanceId),
+						},
+					},
 				},
+				Period: aws.Int32(period),
+				Stat:   aws.String("Sum"),
 			},
-			StartTime: &startDate,
-			EndTime:   &today,
-			Period:    &period,
-			Statistics: []cwTypes.Statistic{
-				cwTypes.StatisticSum,
-			},
+		})
+	}
+
+	var nextToken *string
+	for {
+		slog.Info("retrieving cloudwatch metrics for instances", "region", r.region, "count", len(chunk))
+		input := &cloudwatch.GetMetricDataInput{
+			MetricDataQueries: queries,
+			StartTime:         &startDate,
+			EndTime:           &today,
+			NextToken:         nextToken,
+		}
+
+		if err := cloudwatchLimiter.Wait(ctx); err != nil {
+			return fmt.Errorf("context ended while waiting for cloudwatch rate limiter: %w", err)
+		}
+
+		var res *cloudwatch.GetMetricDataOutput
+		err := withBackoff(ctx, func() error {
+			var apiErr error
+			res, apiErr = cloudwatchClient.GetMetricData(ctx, input)
+			return apiErr
+		})
+		if err != nil {
+			return fmt.Errorf("error retrieving metrics for region %s: %w", r.region, err)
+		}
+
+		for _, msg := range res.Messages {
+			slog.Warn("cloudwatch returned a partial data message", "region", r.region, "code", aws.ToString(msg.Code), "value", aws.ToString(msg.Value))
+		}
+
+		for _, result := range res.MetricDataResults {
+			instance, ok := idToInstance[aws.ToString(result.Id)]
+			if !ok {
+				continue
+			}
+			for _, v := range result.Values {
+				instance.metadataNoTokenCalls += v
+			}
 		}
 
-		res, err := cloudwatchClient.GetMetricStatistics(ctx, input)
+		if res.NextToken == nil {
+			break
+		}
+		nextToken = res.NextToken
+	}
+
+	return nil
+}
 
+// enforceInstances walks the region's instances and, for any instance with zero
+// metadataNoTokenCalls that passes the allow/deny filters, sets HttpTokens=required
+// and HttpEndpoint=enabled (and HttpPutResponseHopLimit when hopLimit is positive)
+// via ModifyInstanceMetadataOptions. In dryRun mode no API call is made; the planned
+// state is recorded instead. The resulting state or error is stored on each instance
+// for later CSV output.
+func (r *RegionInstances) enforceInstances(ctx context.Context, client EC2API, dryRun bool, allow, deny map[string]bool, hopLimit int32) {
+	for _, instance := range r.instances {
+		if instance.metadataNoTokenCalls > 0 {
+			continue
+		}
+		if len(allow) > 0 && !allow[instance.instanceId] {
+			continue
+		}
+		if deny[instance.instanceId] {
+			continue
+		}
+
+		if dryRun {
+			slog.Info("dry-run: would enforce IMDSv2", "instance id", instance.instanceId)
+			instance.enforcedState = "required (dry-run)"
+			continue
+		}
+
+		input := &ec2.ModifyInstanceMetadataOptionsInput{
+			InstanceId:   aws.String(instance.instanceId),
+			HttpTokens:   ec2Types.HttpTokensStateRequired,
+			HttpEndpoint: ec2Types.InstanceMetadataEndpointStateEnabled,
+		}
+		if hopLimit > 0 {
+			input.HttpPutResponseHopLimit = aws.Int32(hopLimit)
+		}
+
+		if err := ec2Limiter.Wait(ctx); err != nil {
+			slog.Warn("context ended while waiting for ec2 rate limiter", "instance id", instance.instanceId, "error", err)
+			instance.enforceErr = err.Error()
+			continue
+		}
+
+		var out *ec2.ModifyInstanceMetadataOptionsOutput
+		err := withBackoff(ctx, func() error {
+			var apiErr error
+			out, apiErr = client.ModifyInstanceMetadataOptions(ctx, input)
+			return apiErr
+		})
 		if err != nil {
-			log.Fatalf("error retrieving metrics for instance %s, %v", instance.instanceId, err)
+			slog.Warn("failed to enforce IMDSv2", "instance id", instance.instanceId, "error", err)
+			instance.enforceErr = err.Error()
+			continue
 		}
 
-		for _, d := range res.Datapoints {
-			instance.metadataNoTokenCalls += *d.Sum
+		if out.InstanceMetadataOptions != nil {
+			instance.enforcedState = string(out.InstanceMetadataOptions.HttpTokens)
 		}
 	}
 }
@@ -2,17 +2,26 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type MockRetrieveInstancePager struct {
 	PageNum int
 	Pages   []*ec2.DescribeInstancesOutput
+	Errs    map[int]error
 }
 
 func (m *MockRetrieveInstancePager) HasMorePages() bool {
@@ -23,48 +32,811 @@ func (m *MockRetrieveInstancePager) NextPage(ctx context.Context, optFns ...func
 	if m.PageNum > len(m.Pages) {
 		return nil, fmt.Errorf("no more pages")
 	}
+	if err, ok := m.Errs[m.PageNum]; ok {
+		m.PageNum++
+		return nil, err
+	}
 	output := m.Pages[m.PageNum]
 	m.PageNum++
 	return output, nil
 }
 
-type MockEc2DescribeRegions struct{}
+// mockAPIError is a minimal smithy.APIError for exercising the error-code
+// handling in retrieveInstances without depending on a real AWS error type.
+type mockAPIError struct {
+	code string
+}
 
-func (m *MockEc2DescribeRegions) DescribeRegions(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
-	uw2, ue1 := "us-west-2", "us-east-1"
-	result := &ec2.DescribeRegionsOutput{Regions: []types.Region{{RegionName: &uw2}, {RegionName: &ue1}}}
-	return result, nil
+func (e *mockAPIError) Error() string        { return e.code }
+func (e *mockAPIError) ErrorCode() string    { return e.code }
+func (e *mockAPIError) ErrorMessage() string { return e.code }
+func (e *mockAPIError) ErrorFault() smithy.ErrorFault {
+	return smithy.FaultUnknown
+}
+
+// MockEC2API is a configurable EC2API implementation for tests; unset fields
+// panic if called, which surfaces tests exercising unexpected calls.
+type MockEC2API struct {
+	describeRegionsFn               func(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error)
+	describeInstancesFn             func(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	modifyInstanceMetadataOptionsFn func(ctx context.Context, params *ec2.ModifyInstanceMetadataOptionsInput, optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceMetadataOptionsOutput, error)
+}
+
+func (m *MockEC2API) DescribeRegions(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
+	return m.describeRegionsFn(ctx, params, optFns...)
+}
+
+func (m *MockEC2API) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	return m.describeInstancesFn(ctx, params, optFns...)
+}
+
+func (m *MockEC2API) ModifyInstanceMetadataOptions(ctx context.Context, params *ec2.ModifyInstanceMetadataOptionsInput, optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceMetadataOptionsOutput, error) {
+	return m.modifyInstanceMetadataOptionsFn(ctx, params, optFns...)
+}
+
+// MockCloudWatchAPI is a configurable CloudWatchAPI implementation for tests.
+type MockCloudWatchAPI struct {
+	getMetricStatisticsFn func(ctx context.Context, params *cloudwatch.GetMetricStatisticsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricStatisticsOutput, error)
+	getMetricDataFn       func(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error)
+}
+
+func (m *MockCloudWatchAPI) GetMetricStatistics(ctx context.Context, params *cloudwatch.GetMetricStatisticsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	return m.getMetricStatisticsFn(ctx, params, optFns...)
+}
+
+func (m *MockCloudWatchAPI) GetMetricData(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+	return m.getMetricDataFn(ctx, params, optFns...)
 }
 
 func TestRetrieveRegions(t *testing.T) {
 	ctx := context.TODO()
 	uw2, ue1 := "us-west-2", "us-east-1"
 	want := []types.Region{{RegionName: &uw2}, {RegionName: &ue1}}
-	got := retrieveRegions(ctx, &MockEc2DescribeRegions{})
 
-	reflect.DeepEqual(got, want)
+	client := &MockEC2API{
+		describeRegionsFn: func(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
+			return &ec2.DescribeRegionsOutput{Regions: want}, nil
+		},
+	}
+	got, err := retrieveRegions(ctx, client)
+	if err != nil {
+		t.Fatalf("retrieveRegions() error = %v, want nil", err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("retrieveRegions() = %+v, want %+v", got, want)
+	}
+}
+
+func TestRetrieveRegionsRetriesThrottling(t *testing.T) {
+	ctx := context.TODO()
+	uw2 := "us-west-2"
+	called := 0
+
+	client := &MockEC2API{
+		describeRegionsFn: func(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
+			called++
+			if called == 1 {
+				return nil, &mockAPIError{code: "Throttling"}
+			}
+			return &ec2.DescribeRegionsOutput{Regions: []types.Region{{RegionName: &uw2}}}, nil
+		},
+	}
+
+	got, err := retrieveRegions(ctx, client)
+	if err != nil {
+		t.Fatalf("retrieveRegions() error = %v, want nil", err)
+	}
+	if len(got) != 1 || *got[0].RegionName != uw2 {
+		t.Errorf("retrieveRegions() = %+v, want one region %q", got, uw2)
+	}
+}
+
+func TestRetrieveRegionsNonRetryableError(t *testing.T) {
+	ctx := context.TODO()
+
+	client := &MockEC2API{
+		describeRegionsFn: func(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
+			return nil, &mockAPIError{code: "InternalError"}
+		},
+	}
+
+	if _, err := retrieveRegions(ctx, client); err == nil {
+		t.Errorf("retrieveRegions() error = nil, want error")
+	}
 }
 
 func TestAddInstance(t *testing.T) {
-	ri := RegionInstances{"us-west-2", []*Ec2Instance{}}
-	ri.addInstance(&Ec2Instance{"123", 2.0})
-	want := RegionInstances{"us-west-2", []*Ec2Instance{{"123", 2.0}}}
+	ri := RegionInstances{region: "us-west-2", instances: []*Ec2Instance{}}
+	ri.addInstance(&Ec2Instance{instanceId: "123", metadataNoTokenCalls: 2.0})
+	want := RegionInstances{region: "us-west-2", instances: []*Ec2Instance{{instanceId: "123", metadataNoTokenCalls: 2.0}}}
 
-	reflect.DeepEqual(ri, want)
+	if !reflect.DeepEqual(ri, want) {
+		t.Errorf("addInstance() = %+v, want %+v", ri, want)
+	}
 }
 
 func TestRetrieveInstances(t *testing.T) {
-	ctx := context.TODO()
 	ione, itwo := "123", "234"
+
+	tests := []struct {
+		name    string
+		pager   *MockRetrieveInstancePager
+		want    RegionInstances
+		wantErr bool
+	}{
+		{
+			name: "multiple pages",
+			pager: &MockRetrieveInstancePager{
+				Pages: []*ec2.DescribeInstancesOutput{
+					{Reservations: []types.Reservation{{Instances: []types.Instance{{InstanceId: &ione}}}}},
+					{Reservations: []types.Reservation{{Instances: []types.Instance{{InstanceId: &itwo}}}}},
+				},
+			},
+			want: RegionInstances{region: "us-west-2", instances: []*Ec2Instance{{instanceId: "123"}, {instanceId: "234"}}},
+		},
+		{
+			name: "unauthorized operation returns error",
+			pager: &MockRetrieveInstancePager{
+				Pages: []*ec2.DescribeInstancesOutput{{}},
+				Errs:  map[int]error{0: &mockAPIError{code: "UnauthorizedOperation"}},
+			},
+			want:    RegionInstances{region: "us-west-2", instances: []*Ec2Instance{}},
+			wantErr: true,
+		},
+		{
+			name: "non-retryable error returns error",
+			pager: &MockRetrieveInstancePager{
+				Pages: []*ec2.DescribeInstancesOutput{{}},
+				Errs:  map[int]error{0: &mockAPIError{code: "InternalError"}},
+			},
+			want:    RegionInstances{region: "us-west-2", instances: []*Ec2Instance{}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.TODO()
+			ri := RegionInstances{region: "us-west-2", instances: []*Ec2Instance{}}
+			err := ri.retrieveInstances(ctx, tt.pager)
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("retrieveInstances() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(ri, tt.want) {
+				t.Errorf("retrieveInstances() = %+v, want %+v", ri, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetrieveInstancesRetriesThrottling(t *testing.T) {
+	ctx := context.TODO()
+	ione := "123"
 	pager := &MockRetrieveInstancePager{
 		Pages: []*ec2.DescribeInstancesOutput{
 			{Reservations: []types.Reservation{{Instances: []types.Instance{{InstanceId: &ione}}}}},
-			{Reservations: []types.Reservation{{Instances: []types.Instance{{InstanceId: &itwo}}}}},
 		},
 	}
+	// wrap NextPage so the first call is throttled and the retry succeeds
+	throttledOnce := &throttleOnceEc2Paginator{inner: pager, err: &mockAPIError{code: "Throttling"}}
+
+	ri := RegionInstances{region: "us-west-2", instances: []*Ec2Instance{}}
+	err := ri.retrieveInstances(ctx, throttledOnce)
+
+	if err != nil {
+		t.Fatalf("retrieveInstances() error = %v, want nil", err)
+	}
+	if throttledOnce.calls != 2 {
+		t.Errorf("NextPage called %d times, want 2", throttledOnce.calls)
+	}
+	if len(ri.instances) != 1 || ri.instances[0].instanceId != "123" {
+		t.Errorf("retrieveInstances() = %+v, want one instance 123", ri)
+	}
+}
+
+// throttleOnceEc2Paginator fails the first NextPage call with a retryable error,
+// then delegates to inner for every call after.
+type throttleOnceEc2Paginator struct {
+	inner ec2DescribeInstancesPaginator
+	err   error
+	calls int
+}
+
+func (p *throttleOnceEc2Paginator) HasMorePages() bool {
+	return p.inner.HasMorePages()
+}
+
+func (p *throttleOnceEc2Paginator) NextPage(ctx context.Context, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	p.calls++
+	if p.calls == 1 {
+		return nil, p.err
+	}
+	return p.inner.NextPage(ctx, optFns...)
+}
+
+func TestRetrieveCloudwatchMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []cwTypes.MetricDataResult
+		want    float64
+	}{
+		{
+			name:    "no values leaves calls at zero",
+			results: []cwTypes.MetricDataResult{{Id: aws.String("m0")}},
+			want:    0,
+		},
+		{
+			name:    "single value",
+			results: []cwTypes.MetricDataResult{{Id: aws.String("m0"), Values: []float64{5}}},
+			want:    5,
+		},
+		{
+			name:    "multiple values are summed",
+			results: []cwTypes.MetricDataResult{{Id: aws.String("m0"), Values: []float64{3, 4}}},
+			want:    7,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.TODO()
+			client := &MockCloudWatchAPI{
+				getMetricDataFn: func(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+					return &cloudwatch.GetMetricDataOutput{MetricDataResults: tt.results}, nil
+				},
+			}
+
+			ri := RegionInstances{region: "us-west-2", instances: []*Ec2Instance{{instanceId: "123"}}}
+			if err := ri.retrieveCloudwatchMetrics(ctx, client); err != nil {
+				t.Fatalf("retrieveCloudwatchMetrics() error = %v, want nil", err)
+			}
+
+			if got := ri.instances[0].metadataNoTokenCalls; got != tt.want {
+				t.Errorf("metadataNoTokenCalls = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetrieveCloudwatchMetricsPaginates(t *testing.T) {
+	ctx := context.TODO()
+	calls := 0
+	client := &MockCloudWatchAPI{
+		getMetricDataFn: func(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+			calls++
+			if params.NextToken == nil {
+				return &cloudwatch.GetMetricDataOutput{
+					MetricDataResults: []cwTypes.MetricDataResult{{Id: aws.String("m0"), Values: []float64{1}}},
+					NextToken:         aws.String("page-2"),
+				}, nil
+			}
+			return &cloudwatch.GetMetricDataOutput{
+				MetricDataResults: []cwTypes.MetricDataResult{{Id: aws.String("m0"), Values: []float64{2}}},
+			}, nil
+		},
+	}
+
+	ri := RegionInstances{region: "us-west-2", instances: []*Ec2Instance{{instanceId: "123"}}}
+	if err := ri.retrieveCloudwatchMetrics(ctx, client); err != nil {
+		t.Fatalf("retrieveCloudwatchMetrics() error = %v, want nil", err)
+	}
+
+	if calls != 2 {
+		t.Errorf("GetMetricData called %d times, want 2", calls)
+	}
+	if got := ri.instances[0].metadataNoTokenCalls; got != 3 {
+		t.Errorf("metadataNoTokenCalls = %v, want 3", got)
+	}
+}
+
+func TestRetrieveCloudwatchMetricsRetriesThrottling(t *testing.T) {
+	ctx := context.TODO()
+	calls := 0
+	client := &MockCloudWatchAPI{
+		getMetricDataFn: func(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+			calls++
+			if calls == 1 {
+				return nil, &mockAPIError{code: "Throttling"}
+			}
+			return &cloudwatch.GetMetricDataOutput{
+				MetricDataResults: []cwTypes.MetricDataResult{{Id: aws.String("m0"), Values: []float64{4}}},
+			}, nil
+		},
+	}
+
+	ri := RegionInstances{region: "us-west-2", instances: []*Ec2Instance{{instanceId: "123"}}}
+	if err := ri.retrieveCloudwatchMetrics(ctx, client); err != nil {
+		t.Fatalf("retrieveCloudwatchMetrics() error = %v, want nil", err)
+	}
+
+	if calls != 2 {
+		t.Errorf("GetMetricData called %d times, want 2", calls)
+	}
+	if got := ri.instances[0].metadataNoTokenCalls; got != 4 {
+		t.Errorf("metadataNoTokenCalls = %v, want 4", got)
+	}
+}
+
+func TestRetrieveCloudwatchMetricsNonRetryableError(t *testing.T) {
+	ctx := context.TODO()
+	client := &MockCloudWatchAPI{
+		getMetricDataFn: func(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+			return nil, &mockAPIError{code: "InternalError"}
+		},
+	}
+
+	ri := RegionInstances{region: "us-west-2", instances: []*Ec2Instance{{instanceId: "123"}}}
+	if err := ri.retrieveCloudwatchMetrics(ctx, client); err == nil {
+		t.Fatal("retrieveCloudwatchMetrics() error = nil, want non-nil")
+	}
+}
+
+func TestEnforceInstances(t *testing.T) {
+	tests := []struct {
+		name       string
+		instance   *Ec2Instance
+		dryRun     bool
+		allow      map[string]bool
+		deny       map[string]bool
+		hopLimit   int32
+		modifyFn   func(ctx context.Context, params *ec2.ModifyInstanceMetadataOptionsInput, optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceMetadataOptionsOutput, error)
+		wantCalled bool
+		wantState  string
+		wantErr    string
+		wantHop    *int32
+	}{
+		{
+			name:       "dry-run makes no api call",
+			instance:   &Ec2Instance{instanceId: "123"},
+			dryRun:     true,
+			wantCalled: false,
+			wantState:  "required (dry-run)",
+		},
+		{
+			name:       "allow-list excludes instance not on it",
+			instance:   &Ec2Instance{instanceId: "123"},
+			allow:      map[string]bool{"234": true},
+			wantCalled: false,
+		},
+		{
+			name:       "deny-list excludes instance on it",
+			instance:   &Ec2Instance{instanceId: "123"},
+			deny:       map[string]bool{"123": true},
+			wantCalled: false,
+		},
+		{
+			name:       "instance with imdsv1 calls is skipped",
+			instance:   &Ec2Instance{instanceId: "123", metadataNoTokenCalls: 2.0},
+			wantCalled: false,
+		},
+		{
+			name:     "hop limit is wired into the request",
+			instance: &Ec2Instance{instanceId: "123"},
+			hopLimit: 2,
+			modifyFn: func(ctx context.Context, params *ec2.ModifyInstanceMetadataOptionsInput, optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceMetadataOptionsOutput, error) {
+				return &ec2.ModifyInstanceMetadataOptionsOutput{InstanceMetadataOptions: &types.InstanceMetadataOptionsResponse{HttpTokens: types.HttpTokensStateRequired}}, nil
+			},
+			wantCalled: true,
+			wantState:  "required",
+			wantHop:    aws.Int32(2),
+		},
+		{
+			name:     "api error populates enforceErr",
+			instance: &Ec2Instance{instanceId: "123"},
+			modifyFn: func(ctx context.Context, params *ec2.ModifyInstanceMetadataOptionsInput, optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceMetadataOptionsOutput, error) {
+				return nil, &mockAPIError{code: "InternalError"}
+			},
+			wantCalled: true,
+			wantErr:    "InternalError",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			var gotHop *int32
+			modifyFn := tt.modifyFn
+			if modifyFn == nil {
+				modifyFn = func(ctx context.Context, params *ec2.ModifyInstanceMetadataOptionsInput, optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceMetadataOptionsOutput, error) {
+					return &ec2.ModifyInstanceMetadataOptionsOutput{}, nil
+				}
+			}
+			client := &MockEC2API{
+				modifyInstanceMetadataOptionsFn: func(ctx context.Context, params *ec2.ModifyInstanceMetadataOptionsInput, optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceMetadataOptionsOutput, error) {
+					called = true
+					gotHop = params.HttpPutResponseHopLimit
+					return modifyFn(ctx, params, optFns...)
+				},
+			}
+
+			ri := &RegionInstances{region: "us-west-2", instances: []*Ec2Instance{tt.instance}}
+			ri.enforceInstances(context.TODO(), client, tt.dryRun, tt.allow, tt.deny, tt.hopLimit)
+
+			if called != tt.wantCalled {
+				t.Errorf("api called = %v, want %v", called, tt.wantCalled)
+			}
+			if tt.instance.enforcedState != tt.wantState {
+				t.Errorf("enforcedState = %q, want %q", tt.instance.enforcedState, tt.wantState)
+			}
+			if tt.wantErr != "" && tt.instance.enforceErr != tt.wantErr {
+				t.Errorf("enforceErr = %q, want %q", tt.instance.enforceErr, tt.wantErr)
+			}
+			if tt.wantErr == "" && tt.instance.enforceErr != "" {
+				t.Errorf("enforceErr = %q, want empty", tt.instance.enforceErr)
+			}
+			if tt.wantHop != nil {
+				if gotHop == nil || *gotHop != *tt.wantHop {
+					t.Errorf("HttpPutResponseHopLimit = %v, want %v", gotHop, tt.wantHop)
+				}
+			}
+		})
+	}
+}
+
+// withMockClients swaps newEC2Client/newCloudWatchClient for the duration of a test
+// so scanRegion/scanAllRegions can be exercised against mocks instead of live AWS
+// calls, restoring the real constructors on cleanup.
+func withMockClients(t *testing.T, ec2 func(cfg aws.Config) EC2API, cw func(cfg aws.Config) CloudWatchAPI) {
+	t.Helper()
+	origEC2, origCW := newEC2Client, newCloudWatchClient
+	newEC2Client, newCloudWatchClient = ec2, cw
+	t.Cleanup(func() {
+		newEC2Client, newCloudWatchClient = origEC2, origCW
+	})
+}
+
+func zeroMetricCloudWatchClient(cfg aws.Config) CloudWatchAPI {
+	return &MockCloudWatchAPI{
+		getMetricDataFn: func(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+			results := make([]cwTypes.MetricDataResult, len(params.MetricDataQueries))
+			for i, q := range params.MetricDataQueries {
+				results[i] = cwTypes.MetricDataResult{Id: q.Id, Values: []float64{0}}
+			}
+			return &cloudwatch.GetMetricDataOutput{MetricDataResults: results}, nil
+		},
+	}
+}
+
+func TestScanRegionRecordsSkipOnInstancesError(t *testing.T) {
+	withMockClients(t,
+		func(cfg aws.Config) EC2API {
+			return &MockEC2API{
+				describeInstancesFn: func(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+					return nil, &mockAPIError{code: "InternalError"}
+				},
+			}
+		},
+		zeroMetricCloudWatchClient,
+	)
+
+	skips := &skipTracker{}
+	results := make(chan *RegionInstances, 1)
+	if err := scanRegion(context.TODO(), aws.Config{}, "us-west-2", false, false, nil, nil, 0, "", "", results, skips); err != nil {
+		t.Fatalf("scanRegion() error = %v, want nil", err)
+	}
+	close(results)
+
+	if got := <-results; got != nil {
+		t.Errorf("scanRegion() sent %+v on results, want nothing", got)
+	}
+	if len(skips.skips) != 1 {
+		t.Errorf("skips = %v, want one recorded skip", skips.skips)
+	}
+}
+
+func TestScanRegionStopsOnContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	id := "i-123"
+
+	withMockClients(t,
+		func(cfg aws.Config) EC2API {
+			return &MockEC2API{
+				describeInstancesFn: func(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+					return &ec2.DescribeInstancesOutput{Reservations: []types.Reservation{{Instances: []types.Instance{{InstanceId: &id}}}}}, nil
+				},
+			}
+		},
+		func(cfg aws.Config) CloudWatchAPI {
+			return &MockCloudWatchAPI{
+				getMetricDataFn: func(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+					// Cancel once the region has real work in flight, so the final
+					// send to results (on an unbuffered, unread channel) has to pick
+					// the ctx.Done() branch of scanRegion's select instead of blocking.
+					cancel()
+					return &cloudwatch.GetMetricDataOutput{MetricDataResults: []cwTypes.MetricDataResult{{Id: params.MetricDataQueries[0].Id, Values: []float64{0}}}}, nil
+				},
+			}
+		},
+	)
+
+	results := make(chan *RegionInstances)
+	err := scanRegion(ctx, aws.Config{}, "us-west-2", false, false, nil, nil, 0, "", "", results, &skipTracker{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("scanRegion() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestScanAllRegionsIsolatesPerRegionErrors(t *testing.T) {
+	uw2, ue1 := "us-west-2", "us-east-1"
+	id := "i-123"
+
+	withMockClients(t,
+		func(cfg aws.Config) EC2API {
+			return &MockEC2API{
+				describeRegionsFn: func(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
+					return &ec2.DescribeRegionsOutput{Regions: []types.Region{{RegionName: &uw2}, {RegionName: &ue1}}}, nil
+				},
+				describeInstancesFn: func(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+					if cfg.Region == "us-east-1" {
+						return nil, &mockAPIError{code: "InternalError"}
+					}
+					return &ec2.DescribeInstancesOutput{Reservations: []types.Reservation{{Instances: []types.Instance{{InstanceId: &id}}}}}, nil
+				},
+			}
+		},
+		zeroMetricCloudWatchClient,
+	)
+
+	results, skips, err := scanAllRegions(context.TODO(), aws.Config{}, 2, false, false, nil, nil, 0, "", "")
+	if err != nil {
+		t.Fatalf("scanAllRegions() error = %v, want nil", err)
+	}
 
-	ri := RegionInstances{"us-west-2", []*Ec2Instance{}}
-	ri.retrieveInstances(ctx, pager)
-	want := RegionInstances{"us-west-2", []*Ec2Instance{{"123", 2.0}, {"234", 2.0}}}
-	reflect.DeepEqual(ri, want)
+	var got []*RegionInstances
+	for ri := range results {
+		got = append(got, ri)
+	}
+
+	if len(got) != 1 || got[0].region != "us-west-2" {
+		t.Errorf("scanAllRegions() results = %+v, want one region (us-west-2)", got)
+	}
+	if len(skips.skips) != 1 {
+		t.Errorf("skips = %v, want one recorded skip for us-east-1", skips.skips)
+	}
+}
+
+func TestScanAllRegionsReturnsErrorOnDescribeRegionsFailure(t *testing.T) {
+	withMockClients(t,
+		func(cfg aws.Config) EC2API {
+			return &MockEC2API{
+				describeRegionsFn: func(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
+					return nil, &mockAPIError{code: "InternalError"}
+				},
+			}
+		},
+		zeroMetricCloudWatchClient,
+	)
+
+	if _, _, err := scanAllRegions(context.TODO(), aws.Config{}, 2, false, false, nil, nil, 0, "", ""); err == nil {
+		t.Errorf("scanAllRegions() error = nil, want error")
+	}
+}
+
+func TestIsRetryableAWSError(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"Throttling", true},
+		{"RequestLimitExceeded", true},
+		{"UnauthorizedOperation", false},
+		{"InternalError", false},
+	}
+
+	for _, tt := range tests {
+		if got := isRetryableAWSError(&mockAPIError{code: tt.code}); got != tt.want {
+			t.Errorf("isRetryableAWSError(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestWithBackoffGivesUpOnNonRetryableError(t *testing.T) {
+	ctx := context.TODO()
+	calls := 0
+	wantErr := &mockAPIError{code: "InternalError"}
+
+	err := withBackoff(ctx, func() error {
+		calls++
+		return wantErr
+	})
+
+	if err != wantErr {
+		t.Errorf("withBackoff() error = %v, want %v", err, wantErr)
+	}
+	if calls != 1 {
+		t.Errorf("fn called %d times, want 1", calls)
+	}
+}
+
+func TestParseIdList(t *testing.T) {
+	got := parseIdList(" i-123 ,i-234,,i-345")
+	want := map[string]bool{"i-123": true, "i-234": true, "i-345": true}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseIdList() = %v, want %v", got, want)
+	}
+
+	if empty := parseIdList(""); len(empty) != 0 {
+		t.Errorf("parseIdList(\"\") = %v, want empty set", empty)
+	}
+}
+
+func TestParseColumnList(t *testing.T) {
+	got := parseColumnList(" Name , Owner,,Env")
+	want := []string{"Name", "Owner", "Env"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseColumnList() = %v, want %v", got, want)
+	}
+
+	if empty := parseColumnList(""); len(empty) != 0 {
+		t.Errorf("parseColumnList(\"\") = %v, want empty slice", empty)
+	}
+}
+
+func TestRoleArnsToAssume(t *testing.T) {
+	got, err := roleArnsToAssume("arn:aws:iam::111111111111:role/scanner", "")
+	if err != nil {
+		t.Fatalf("roleArnsToAssume() error = %v, want nil", err)
+	}
+	want := []string{"arn:aws:iam::111111111111:role/scanner"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("roleArnsToAssume() = %v, want %v", got, want)
+	}
+
+	accountsFile := filepath.Join(t.TempDir(), "accounts.txt")
+	contents := "arn:aws:iam::111111111111:role/scanner\n\n# a comment\n  arn:aws:iam::222222222222:role/scanner  \n"
+	if err := os.WriteFile(accountsFile, []byte(contents), 0o644); err != nil {
+		t.Fatalf("unable to write accounts file: %v", err)
+	}
+
+	got, err = roleArnsToAssume("", accountsFile)
+	if err != nil {
+		t.Fatalf("roleArnsToAssume() error = %v, want nil", err)
+	}
+	want = []string{"arn:aws:iam::111111111111:role/scanner", "arn:aws:iam::222222222222:role/scanner"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("roleArnsToAssume() = %v, want %v", got, want)
+	}
+
+	if _, err := roleArnsToAssume("", filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Errorf("roleArnsToAssume() error = nil, want error for missing file")
+	}
+}
+
+func TestParseTagFilter(t *testing.T) {
+	tests := []struct {
+		name      string
+		filter    string
+		wantKey   string
+		wantValue string
+	}{
+		{name: "empty filter matches everything", filter: "", wantKey: "", wantValue: ""},
+		{name: "key and value", filter: "Owner=platform-team", wantKey: "Owner", wantValue: "platform-team"},
+		{name: "key with no value", filter: "Owner=", wantKey: "Owner", wantValue: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotKey, gotValue := parseTagFilter(tt.filter)
+			if gotKey != tt.wantKey || gotValue != tt.wantValue {
+				t.Errorf("parseTagFilter(%q) = (%q, %q), want (%q, %q)", tt.filter, gotKey, gotValue, tt.wantKey, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestMatchesTagFilter(t *testing.T) {
+	instance := &Ec2Instance{instanceId: "123", tags: map[string]string{"Owner": "platform-team"}}
+
+	if !matchesTagFilter(instance, "", "") {
+		t.Errorf("matchesTagFilter() with empty key = false, want true")
+	}
+	if !matchesTagFilter(instance, "Owner", "platform-team") {
+		t.Errorf("matchesTagFilter() with matching tag = false, want true")
+	}
+	if matchesTagFilter(instance, "Owner", "someone-else") {
+		t.Errorf("matchesTagFilter() with mismatched value = true, want false")
+	}
+	if matchesTagFilter(instance, "Env", "prod") {
+		t.Errorf("matchesTagFilter() with missing key = true, want false")
+	}
+}
+
+func TestTagsToMap(t *testing.T) {
+	got := tagsToMap([]types.Tag{
+		{Key: aws.String("Owner"), Value: aws.String("platform-team")},
+		{Key: aws.String("Env"), Value: aws.String("prod")},
+	})
+	want := map[string]string{"Owner": "platform-team", "Env": "prod"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tagsToMap() = %v, want %v", got, want)
+	}
+
+	if got := tagsToMap(nil); got != nil {
+		t.Errorf("tagsToMap(nil) = %v, want nil", got)
+	}
+}
+
+func TestPublishScanResetsStaleSeries(t *testing.T) {
+	t.Cleanup(func() {
+		imdsv1CallsTotal.Reset()
+		scanDurationSeconds.Reset()
+	})
+
+	uw2 := "us-west-2"
+	instanceID := "i-1"
+
+	withMockClients(t,
+		func(cfg aws.Config) EC2API {
+			return &MockEC2API{
+				describeRegionsFn: func(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
+					return &ec2.DescribeRegionsOutput{Regions: []types.Region{{RegionName: &uw2}}}, nil
+				},
+				describeInstancesFn: func(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+					return &ec2.DescribeInstancesOutput{Reservations: []types.Reservation{{Instances: []types.Instance{{InstanceId: &instanceID}}}}}, nil
+				},
+			}
+		},
+		func(cfg aws.Config) CloudWatchAPI {
+			return &MockCloudWatchAPI{
+				getMetricDataFn: func(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+					return &cloudwatch.GetMetricDataOutput{MetricDataResults: []cwTypes.MetricDataResult{{Id: params.MetricDataQueries[0].Id, Values: []float64{5}}}}, nil
+				},
+			}
+		},
+	)
+
+	publishScan(context.TODO(), aws.Config{}, 1, "111111111111")
+
+	if got := testutil.ToFloat64(imdsv1CallsTotal.WithLabelValues("us-west-2", "i-1", "111111111111")); got != 5 {
+		t.Errorf("imdsv1CallsTotal after first scan = %v, want 5", got)
+	}
+	if got := testutil.CollectAndCount(imdsv1CallsTotal); got != 1 {
+		t.Errorf("imdsv1CallsTotal series count after first scan = %d, want 1", got)
+	}
+
+	// Simulate the fleet rotating: the old instance is gone, a new one has taken its
+	// place. publishScan must drop i-1's series rather than leaving it stale forever.
+	instanceID = "i-2"
+	publishScan(context.TODO(), aws.Config{}, 1, "111111111111")
+
+	if got := testutil.CollectAndCount(imdsv1CallsTotal); got != 1 {
+		t.Errorf("imdsv1CallsTotal series count after second scan = %d, want 1 (stale i-1 series not dropped)", got)
+	}
+	if got := testutil.ToFloat64(imdsv1CallsTotal.WithLabelValues("us-west-2", "i-2", "111111111111")); got != 5 {
+		t.Errorf("imdsv1CallsTotal after second scan = %v, want 5", got)
+	}
+}
+
+func TestPublishScanSkipsCycleOnScanAllRegionsError(t *testing.T) {
+	t.Cleanup(func() {
+		imdsv1CallsTotal.Reset()
+		scanDurationSeconds.Reset()
+	})
+
+	withMockClients(t,
+		func(cfg aws.Config) EC2API {
+			return &MockEC2API{
+				describeRegionsFn: func(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
+					return nil, &mockAPIError{code: "InternalError"}
+				},
+			}
+		},
+		zeroMetricCloudWatchClient,
+	)
+
+	imdsv1CallsTotal.WithLabelValues("us-west-2", "i-1", "111111111111").Set(5)
+
+	// publishScan must log and return on a scanAllRegions error, leaving the prior
+	// cycle's gauges in place instead of wiping them (or blocking forever ranging over
+	// a nil channel).
+	publishScan(context.TODO(), aws.Config{}, 1, "111111111111")
+
+	if got := testutil.ToFloat64(imdsv1CallsTotal.WithLabelValues("us-west-2", "i-1", "111111111111")); got != 5 {
+		t.Errorf("imdsv1CallsTotal after failed scan = %v, want unchanged 5", got)
+	}
 }